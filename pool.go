@@ -1,21 +1,153 @@
 package gremgo
 
 import (
+	"context"
+	"errors"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// ErrPoolExhausted is returned by GetContext when PoolTimeout elapses while
+// waiting for a connection to become available.
+var ErrPoolExhausted = errors.New("gremgo: pool exhausted, timed out waiting for a connection")
+
+// warmupMinBackoff and warmupMaxBackoff bound the retry delay used by the
+// idle warmup goroutine after a failed dial.
+const (
+	warmupMinBackoff = 100 * time.Millisecond
+	warmupMaxBackoff = 30 * time.Second
+)
+
 // Pool maintains a list of connections.
 type Pool struct {
 	Dial        func() (*Client, error)
 	MaxOpen     int
 	MaxLifetime time.Duration
-	mu          sync.Mutex
-	idle        []*idleConnection
-	open        int
-	cond        *sync.Cond
-	cleanerCh   chan struct{}
-	closed      bool
+	// PoolTimeout is the maximum amount of time a call to Get/GetContext will
+	// wait for a connection before returning ErrPoolExhausted. Zero means wait
+	// indefinitely (subject to the context passed to GetContext). It bounds
+	// only the time spent queued behind MaxOpen; a wait for a DialRateLimit
+	// slot is bounded by the context alone.
+	PoolTimeout time.Duration
+	// MinIdle is the minimum number of idle connections the pool tries to
+	// keep warmed and ready in the background. Zero disables warmup.
+	MinIdle int
+	// MaxIdle caps the number of idle connections kept around; connections
+	// returned (by put or by the warmup goroutine) in excess of MaxIdle are
+	// closed instead of being pooled. Zero (with MinIdle set) is treated as
+	// unbounded.
+	MaxIdle int
+	// IdlePingTimeout is how long a connection may sit idle before Get health
+	// checks it (via TestOnBorrow) rather than handing it straight to the
+	// caller. Zero disables the check.
+	IdlePingTimeout time.Duration
+	// TestOnBorrow, if set, is called on an idle connection that has been
+	// sitting for longer than IdlePingTimeout before Get returns it. A
+	// non-nil error causes the connection to be discarded and a replacement
+	// to be fetched/dialed instead. If nil, defaultTestOnBorrow is used.
+	TestOnBorrow func(c *Client, idleSince time.Time) error
+	// OnEvent, if set, is called synchronously for notable pool events (dial,
+	// dial error, close, evict) so operators can wire them into whatever
+	// metrics system they use without this package depending on it.
+	OnEvent func(PoolEvent)
+	// DialRateLimit, if positive, is the minimum interval enforced between
+	// successive calls to Dial made by Get. It spaces out dials so that a
+	// burst of requests against an empty pool does not fire MaxOpen
+	// concurrent dials at the Neptune endpoint at once.
+	DialRateLimit time.Duration
+	// Policy selects which idle connection Get hands out first. The zero
+	// value is LIFO.
+	Policy Policy
+
+	mu            sync.Mutex
+	idle          []*idleConnection
+	open          int
+	inflightDials int
+	waiters       []chan struct{}
+	cleanerCh     chan struct{}
+	closed        bool
+	lastDialAt    time.Time
+
+	// Stat counters, updated atomically; see Stats.
+	statDials      int64
+	statDialErrors int64
+	statHits       int64
+	statMisses     int64
+	statTimeouts   int64
+	statWaiters    int64
+	statWaitNanos  int64
+}
+
+// PoolEventType identifies the kind of PoolEvent delivered to Pool.OnEvent.
+type PoolEventType int
+
+// Event types delivered to Pool.OnEvent.
+const (
+	EventDial PoolEventType = iota
+	EventDialError
+	EventClose
+	EventEvict
+)
+
+// PoolEvent describes a single notable occurrence in the life of a pooled
+// connection, delivered to Pool.OnEvent.
+type PoolEvent struct {
+	Type PoolEventType
+	Err  error
+}
+
+// emit delivers e to OnEvent, if set.
+func (p *Pool) emit(e PoolEvent) {
+	if p.OnEvent != nil {
+		p.OnEvent(e)
+	}
+}
+
+// PoolStats holds a snapshot of Pool counters, suitable for polling into a
+// metrics system.
+type PoolStats struct {
+	Dials           int64
+	DialErrors      int64
+	Hits            int64 // Get calls served by an idle connection
+	Misses          int64 // Get calls that had to dial
+	Timeouts        int64 // Get calls that returned ErrPoolExhausted
+	Waiters         int64 // times a Get call had to wait for a connection (one call may wait more than once)
+	OpenConnections int
+	IdleConnections int
+	WaitDuration    time.Duration // cumulative time spent waiting
+}
+
+// Stats returns a snapshot of the pool's current counters.
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	open := p.open
+	idle := len(p.idle)
+	p.mu.Unlock()
+
+	return PoolStats{
+		Dials:           atomic.LoadInt64(&p.statDials),
+		DialErrors:      atomic.LoadInt64(&p.statDialErrors),
+		Hits:            atomic.LoadInt64(&p.statHits),
+		Misses:          atomic.LoadInt64(&p.statMisses),
+		Timeouts:        atomic.LoadInt64(&p.statTimeouts),
+		Waiters:         atomic.LoadInt64(&p.statWaiters),
+		OpenConnections: open,
+		IdleConnections: idle,
+		WaitDuration:    time.Duration(atomic.LoadInt64(&p.statWaitNanos)),
+	}
+}
+
+// defaultTestOnBorrow is used when Pool.TestOnBorrow is nil. It issues a
+// trivial traversal to confirm the underlying websocket is still alive;
+// Neptune closes idle connections aggressively, so a cheap round trip is the
+// most reliable way to know a pooled connection still works.
+func defaultTestOnBorrow(c *Client, idleSince time.Time) error {
+	if c == nil {
+		return errors.New("gremgo: nil client")
+	}
+	_, err := c.Execute("g.V().limit(1)", map[string]string{}, map[string]string{})
+	return err
 }
 
 // PooledConnection represents a shared and reusable connection.
@@ -27,60 +159,250 @@ type PooledConnection struct {
 
 type idleConnection struct {
 	pc *PooledConnection
+	// since records when this connection entered the idle slice, used to
+	// decide whether IdlePingTimeout applies.
+	since time.Time
 }
 
 // Get will return an available pooled connection. Either an idle connection or
 // by dialing a new one if the pool does not currently have a maximum number
-// of active connections.
+// of active connections. It is equivalent to calling GetContext with
+// context.Background().
 func (p *Pool) Get() (*PooledConnection, error) {
-	// Lock the pool to keep the kids out.
-	p.mu.Lock()
+	return p.GetContext(context.Background())
+}
+
+// GetContext behaves like Get but honours ctx and p.PoolTimeout while waiting
+// for a connection to become available. If ctx is cancelled first, ctx.Err()
+// is returned; if PoolTimeout elapses first, ErrPoolExhausted is returned.
+func (p *Pool) GetContext(ctx context.Context) (*PooledConnection, error) {
+	// deadline is computed once, up front, so that PoolTimeout bounds the
+	// total time spent queued across the whole call; recomputing it on every retry through the loop below would
+	// let a spurious wakeup (another waiter beating us to the freed slot)
+	// restart the clock and let the call run well past PoolTimeout in
+	// aggregate.
+	var deadline time.Time
+	if p.PoolTimeout > 0 {
+		deadline = time.Now().Add(p.PoolTimeout)
+	}
 
-	// Wait loop
 	for {
-		conn := p.first()
-		if conn != nil {
-			// Remove the connection from the idle slice
-			numIdle := len(p.idle)
-			copy(p.idle, p.idle[1:])
-			p.idle = p.idle[:numIdle-1]
+		p.mu.Lock()
+		p.maybeWarmupLocked()
+
+		conn, stale := p.takeIdleLocked()
+		if conn == nil && len(stale) == 0 {
+			// No idle connections at all, try dialing a new one.
+			if p.MaxOpen == 0 || p.open < p.MaxOpen {
+				p.open++
+				dial := p.Dial
+
+				// Unlock here so that any other connections that need to be
+				// dialed do not have to wait.
+				p.mu.Unlock()
+
+				if err := p.waitForDialToken(ctx); err != nil {
+					p.mu.Lock()
+					p.open--
+					p.release()
+					p.mu.Unlock()
+					return nil, err
+				}
+
+				dc, err := dial()
+				if err != nil {
+					atomic.AddInt64(&p.statDialErrors, 1)
+					p.emit(PoolEvent{Type: EventDialError, Err: err})
+					p.mu.Lock()
+					p.open--
+					p.release()
+					p.mu.Unlock()
+					return nil, err
+				}
+
+				atomic.AddInt64(&p.statDials, 1)
+				atomic.AddInt64(&p.statMisses, 1)
+				p.emit(PoolEvent{Type: EventDial})
+				return &PooledConnection{Pool: p, Client: dc, t: time.Now()}, nil
+			}
+
+			// No idle connections and max active connections, let's wait for
+			// one to be released or dialed for us.
+			atomic.AddInt64(&p.statWaiters, 1)
+			waitStart := time.Now()
+			w := make(chan struct{}, 1)
+			p.waiters = append(p.waiters, w)
 			p.mu.Unlock()
-			pc := &PooledConnection{Pool: p, Client: conn.pc.Client}
-			return pc, nil
+
+			var timeoutCh <-chan time.Time
+			var timer *time.Timer
+			if p.PoolTimeout > 0 {
+				timer = time.NewTimer(time.Until(deadline))
+				timeoutCh = timer.C
+			}
+
+			select {
+			case <-w:
+				if timer != nil {
+					timer.Stop()
+				}
+				atomic.AddInt64(&p.statWaitNanos, int64(time.Since(waitStart)))
+				continue
+			case <-timeoutCh:
+				atomic.AddInt64(&p.statWaitNanos, int64(time.Since(waitStart)))
+				atomic.AddInt64(&p.statTimeouts, 1)
+				p.mu.Lock()
+				p.removeOrForwardWaiterLocked(w)
+				p.mu.Unlock()
+				return nil, ErrPoolExhausted
+			case <-ctx.Done():
+				if timer != nil {
+					timer.Stop()
+				}
+				atomic.AddInt64(&p.statWaitNanos, int64(time.Since(waitStart)))
+				p.mu.Lock()
+				p.removeOrForwardWaiterLocked(w)
+				p.mu.Unlock()
+				return nil, ctx.Err()
+			}
+		}
+
+		// Purging stale connections freed one open slot per entry; wake a
+		// waiter for each freed slot, not just one, or queued waiters beyond
+		// the first would needlessly time out despite free capacity.
+		for i := 0; i < len(stale); i++ {
+			p.release()
+		}
+		p.mu.Unlock()
+
+		for _, c := range stale {
+			p.emit(PoolEvent{Type: EventEvict})
+			if c.pc.Client != nil {
+				c.pc.Client.Close()
+			}
 		}
 
-		// No idle connections, try dialing a new one
-		if p.MaxOpen == 0 || p.open < p.MaxOpen {
-			p.open++
-			dial := p.Dial
+		if conn == nil {
+			// Every idle connection we looked at was stale; retry now that
+			// they have been purged.
+			continue
+		}
 
-			// Unlock here so that any other connections that need to be
-			// dialed do not have to wait.
-			p.mu.Unlock()
+		client := conn.pc.Client
+		since := conn.since
 
-			dc, err := dial()
-			if err != nil {
+		if p.IdlePingTimeout > 0 && time.Since(since) > p.IdlePingTimeout {
+			test := p.TestOnBorrow
+			if test == nil {
+				test = defaultTestOnBorrow
+			}
+			if err := test(client, since); err != nil {
+				p.emit(PoolEvent{Type: EventEvict, Err: err})
+				client.Close()
 				p.mu.Lock()
 				p.open--
 				p.release()
 				p.mu.Unlock()
-				return nil, err
+				continue
 			}
+		}
+
+		atomic.AddInt64(&p.statHits, 1)
+		return &PooledConnection{Pool: p, Client: client, t: conn.pc.t}, nil
+	}
+}
+
+// Policy selects which idle connection Get hands out first.
+type Policy int
+
+const (
+	// LIFO returns the most recently released idle connection first, so hot
+	// connections stay hot and cold ones age out naturally under
+	// MaxLifetime. It is the default (zero value) policy.
+	LIFO Policy = iota
+	// FIFO returns the longest-idle connection first.
+	FIFO
+)
+
+// takeIdleLocked removes and returns an idle connection chosen according to
+// p.Policy. Along the way it also removes (but does not close) any entries
+// whose Client.Errored is set or whose age exceeds MaxLifetime, returning
+// them as stale so the caller can close them outside the lock; the cleaner
+// only runs on a MaxLifetime tick, so without this a caller could receive an
+// expired connection between ticks.
+// It is not threadsafe. The caller should manage locking the pool.
+func (p *Pool) takeIdleLocked() (conn *idleConnection, stale []*idleConnection) {
+	for len(p.idle) > 0 {
+		idx := 0
+		if p.Policy == LIFO {
+			idx = len(p.idle) - 1
+		}
+		c := p.idle[idx]
+		p.idle = append(p.idle[:idx], p.idle[idx+1:]...)
 
-			pc := &PooledConnection{Pool: p, Client: dc, t: time.Now()}
-			return pc, nil
+		if (c.pc.Client != nil && c.pc.Client.Errored) ||
+			(p.MaxLifetime > 0 && time.Now().After(c.pc.t.Add(p.MaxLifetime))) {
+			p.open--
+			stale = append(stale, c)
+			continue
 		}
+		return c, stale
+	}
+	return nil, stale
+}
 
-		//No idle connections and max active connections, let's wait.
-		if p.cond == nil {
-			p.cond = sync.NewCond(&p.mu)
+// waitForDialToken blocks, without holding p.mu, until at least
+// DialRateLimit has elapsed since the previous dial started, or ctx is done.
+// It is a no-op when DialRateLimit is not positive.
+func (p *Pool) waitForDialToken(ctx context.Context) error {
+	if p.DialRateLimit <= 0 {
+		return nil
+	}
+	for {
+		p.mu.Lock()
+		wait := p.lastDialAt.Add(p.DialRateLimit).Sub(time.Now())
+		if wait <= 0 {
+			p.lastDialAt = time.Now()
+			p.mu.Unlock()
+			return nil
 		}
+		p.mu.Unlock()
 
-		p.cond.Wait()
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+			// Re-check under lock; another dial may have taken the slot.
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
 	}
 }
 
-// put pushes the supplied PooledConnection to the top of the idle slice to be reused.
+// removeOrForwardWaiterLocked removes w from the waiter queue if it is still
+// present. If w is no longer in the queue, release() already popped it and
+// delivered a wakeup between w giving up (PoolTimeout/ctx) and this call
+// taking the lock. That wakeup would otherwise be wasted on a waiter that is
+// no longer listening, so it is drained back out of w and forwarded to
+// another queued waiter instead.
+// It is not threadsafe. The caller should manage locking the pool.
+func (p *Pool) removeOrForwardWaiterLocked(w chan struct{}) {
+	for i, waiter := range p.waiters {
+		if waiter == w {
+			p.waiters = append(p.waiters[:i], p.waiters[i+1:]...)
+			return
+		}
+	}
+	select {
+	case <-w:
+	default:
+	}
+	p.release()
+}
+
+// put pushes the supplied PooledConnection to the top of the idle slice to be
+// reused, unless it is errored, past MaxLifetime, or the idle slice is
+// already at MaxIdle, in which case it is closed instead.
 // It is not threadsafe. The caller should manage locking the pool.
 func (p *Pool) put(pc *PooledConnection) {
 	if p.closed {
@@ -90,12 +412,90 @@ func (p *Pool) put(pc *PooledConnection) {
 	if (pc.Client != nil && pc.Client.Errored) ||
 		(p.MaxLifetime > 0 && time.Now().After(pc.t.Add(p.MaxLifetime))) {
 		p.open--
+		p.emit(PoolEvent{Type: EventEvict})
 		pc.Client.Close()
 		return
 	}
-	idle := &idleConnection{pc: pc}
+	if p.MaxIdle > 0 && len(p.idle) >= p.MaxIdle {
+		p.open--
+		p.emit(PoolEvent{Type: EventEvict})
+		pc.Client.Close()
+		return
+	}
+	idle := &idleConnection{pc: pc, since: time.Now()}
 	p.idle = append(p.idle, idle)
 	p.startCleanerLocked()
+	p.maybeWarmupLocked()
+}
+
+// maybeWarmupLocked schedules asynchronous dials so that len(p.idle) plus
+// any dials already in flight reaches MinIdle, without exceeding MaxOpen.
+// It is not threadsafe. The caller should manage locking the pool.
+func (p *Pool) maybeWarmupLocked() {
+	if p.closed || p.MinIdle <= 0 || p.Dial == nil {
+		return
+	}
+	for len(p.idle)+p.inflightDials < p.MinIdle {
+		if p.MaxOpen > 0 && p.open+p.inflightDials >= p.MaxOpen {
+			return
+		}
+		p.inflightDials++
+		go p.warmupDial()
+	}
+}
+
+// warmupDial dials a single connection in the background on behalf of
+// maybeWarmupLocked and, on success, adds it to the idle slice (subject to
+// MaxIdle and MaxOpen; the latter is re-checked here because GetContext may
+// have dialed concurrently while this dial was in flight). Failed dials are
+// retried with an increasing backoff so that a struggling or unreachable
+// Neptune endpoint is not hammered; callers of Get are never blocked by this
+// goroutine.
+func (p *Pool) warmupDial() {
+	defer func() {
+		p.mu.Lock()
+		p.inflightDials--
+		p.mu.Unlock()
+	}()
+
+	backoff := warmupMinBackoff
+	for {
+		p.mu.Lock()
+		closed := p.closed
+		dial := p.Dial
+		p.mu.Unlock()
+		if closed || dial == nil {
+			return
+		}
+
+		c, err := dial()
+		if err != nil {
+			atomic.AddInt64(&p.statDialErrors, 1)
+			p.emit(PoolEvent{Type: EventDialError, Err: err})
+			time.Sleep(backoff)
+			backoff *= 2
+			if backoff > warmupMaxBackoff {
+				backoff = warmupMaxBackoff
+			}
+			continue
+		}
+		atomic.AddInt64(&p.statDials, 1)
+		p.emit(PoolEvent{Type: EventDial})
+
+		p.mu.Lock()
+		if p.closed || (p.MaxIdle > 0 && len(p.idle) >= p.MaxIdle) ||
+			(p.MaxOpen > 0 && p.open >= p.MaxOpen) {
+			p.mu.Unlock()
+			c.Close()
+			return
+		}
+		p.open++
+		now := time.Now()
+		p.idle = append(p.idle, &idleConnection{pc: &PooledConnection{Pool: p, Client: c, t: now}, since: now})
+		p.release()
+		p.mu.Unlock()
+		return
+	}
 }
 
 func (p *Pool) needStartCleaner() bool {
@@ -150,9 +550,11 @@ func (p *Pool) connectionCleaner() {
 				i--
 			}
 		}
+		p.maybeWarmupLocked()
 		p.mu.Unlock()
 
 		for _, c := range closing {
+			p.emit(PoolEvent{Type: EventEvict})
 			if c.pc.Client != nil {
 				c.pc.Client.Close()
 			}
@@ -162,23 +564,19 @@ func (p *Pool) connectionCleaner() {
 	}
 }
 
-// release decrements active and alerts waiters.
+// release wakes the oldest queued waiter, if any, so it can retry taking an
+// idle connection or dialing one. w is buffered (capacity 1), so the send
+// below never blocks, even if the waiter has since given up on
+// PoolTimeout/ctx; removeOrForwardWaiterLocked is responsible for detecting
+// that case and forwarding the wakeup on instead of letting it go to waste.
 // It is not threadsafe. The caller should manage locking the pool.
 func (p *Pool) release() {
-	if p.closed {
+	if p.closed || len(p.waiters) == 0 {
 		return
 	}
-	if p.cond != nil {
-		p.cond.Signal()
-	}
-
-}
-
-func (p *Pool) first() *idleConnection {
-	if len(p.idle) == 0 {
-		return nil
-	}
-	return p.idle[0]
+	w := p.waiters[0]
+	p.waiters = p.waiters[1:]
+	w <- struct{}{}
 }
 
 // Close closes the pool.
@@ -190,6 +588,7 @@ func (p *Pool) Close() {
 		close(p.cleanerCh)
 	}
 	for _, c := range p.idle {
+		p.emit(PoolEvent{Type: EventClose})
 		c.pc.Client.Close()
 	}
 	p.closed = true
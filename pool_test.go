@@ -1,6 +1,8 @@
 package gremgo
 
 import (
+	"context"
+	"errors"
 	"testing"
 	"time"
 )
@@ -93,35 +95,383 @@ func TestPooledConnectionClose(t *testing.T) {
 	}
 }
 
-func TestFirst(t *testing.T) {
+func TestPooledConnectionCloseRespectsMaxIdle(t *testing.T) {
+	pool := &Pool{MaxIdle: 2}
+
+	for i := 0; i < 4; i++ {
+		pc := &PooledConnection{Pool: pool, Client: &Client{}}
+		pool.open++
+		pc.Close()
+	}
+
+	if len(pool.idle) != 2 {
+		t.Fatalf("Expected idle to be capped at MaxIdle=2, got %d", len(pool.idle))
+	}
+
+	if pool.open != 2 {
+		t.Errorf("Expected open to be decremented for each connection closed over MaxIdle, got %d", pool.open)
+	}
+}
+
+func TestTakeIdleLockedFIFOOrder(t *testing.T) {
+	pool := &Pool{Policy: FIFO}
+	a := &idleConnection{pc: &PooledConnection{Pool: pool, Client: &Client{}}}
+	b := &idleConnection{pc: &PooledConnection{Pool: pool, Client: &Client{}}}
+	pool.idle = []*idleConnection{a, b}
+
+	conn, stale := pool.takeIdleLocked()
+
+	if conn != a {
+		t.Error("Expected FIFO policy to return the oldest (first) idle connection")
+	}
+	if len(stale) != 0 {
+		t.Errorf("Expected no stale connections, got %d", len(stale))
+	}
+	if len(pool.idle) != 1 || pool.idle[0] != b {
+		t.Error("Expected the remaining connection to stay in the idle slice")
+	}
+}
+
+func TestTakeIdleLockedLIFOOrder(t *testing.T) {
+	pool := &Pool{} // Policy zero value is LIFO
+	a := &idleConnection{pc: &PooledConnection{Pool: pool, Client: &Client{}}}
+	b := &idleConnection{pc: &PooledConnection{Pool: pool, Client: &Client{}}}
+	pool.idle = []*idleConnection{a, b}
+
+	conn, stale := pool.takeIdleLocked()
+
+	if conn != b {
+		t.Error("Expected LIFO (default) policy to return the most recently released idle connection")
+	}
+	if len(stale) != 0 {
+		t.Errorf("Expected no stale connections, got %d", len(stale))
+	}
+	if len(pool.idle) != 1 || pool.idle[0] != a {
+		t.Error("Expected the remaining connection to stay in the idle slice")
+	}
+}
+
+func TestTakeIdleLockedPurgesStaleBeforeReturningFresh(t *testing.T) {
 	n := time.Now()
-	pool := &Pool{MaxOpen: 1, MaxLifetime: 30 * time.Millisecond}
-	idled := []*idleConnection{
-		&idleConnection{pc: &PooledConnection{Pool: pool, Client: &Client{}, t: n.Add(-45 * time.Millisecond)}}, // expired
-		&idleConnection{pc: &PooledConnection{Pool: pool, Client: &Client{}, t: n.Add(-45 * time.Millisecond)}}, // expired
-		&idleConnection{pc: &PooledConnection{Pool: pool, Client: &Client{}}},                                   // valid
+	pool := &Pool{Policy: FIFO, MaxLifetime: 10 * time.Millisecond, open: 3}
+	expired1 := &idleConnection{pc: &PooledConnection{Pool: pool, Client: &Client{}, t: n.Add(-time.Hour)}}
+	expired2 := &idleConnection{pc: &PooledConnection{Pool: pool, Client: &Client{Errored: true}, t: n}}
+	fresh := &idleConnection{pc: &PooledConnection{Pool: pool, Client: &Client{}, t: n}}
+	pool.idle = []*idleConnection{expired1, expired2, fresh}
+
+	conn, stale := pool.takeIdleLocked()
+
+	if conn != fresh {
+		t.Error("Expected the fresh connection to be returned once stale ones are purged")
+	}
+	if len(stale) != 2 {
+		t.Fatalf("Expected 2 stale connections, got %d", len(stale))
+	}
+	if len(pool.idle) != 0 {
+		t.Errorf("Expected idle slice to be drained, got %d", len(pool.idle))
+	}
+	if pool.open != 1 {
+		t.Errorf("Expected open to be decremented for each stale connection, got %d", pool.open)
+	}
+}
+
+func TestTakeIdleLockedAllStaleReturnsNil(t *testing.T) {
+	n := time.Now()
+	pool := &Pool{MaxLifetime: 10 * time.Millisecond, open: 1}
+	pool.idle = []*idleConnection{
+		{pc: &PooledConnection{Pool: pool, Client: &Client{}, t: n.Add(-time.Hour)}},
+	}
+
+	conn, stale := pool.takeIdleLocked()
+
+	if conn != nil {
+		t.Error("Expected nil when every idle connection is stale")
+	}
+	if len(stale) != 1 {
+		t.Errorf("Expected 1 stale connection, got %d", len(stale))
+	}
+}
+
+func TestGetContextPoolExhausted(t *testing.T) {
+	pool := &Pool{MaxOpen: 1, PoolTimeout: 20 * time.Millisecond}
+	pool.Dial = func() (*Client, error) {
+		return &Client{}, nil
+	}
+
+	// Take the only available slot.
+	conn, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
 	}
-	pool.idle = idled
 
-	if len(pool.idle) != 3 {
-		t.Errorf("Expected 3 idle connection, got %d", len(pool.idle))
+	_, err = pool.GetContext(context.Background())
+	if err != ErrPoolExhausted {
+		t.Errorf("Expected ErrPoolExhausted, got %v", err)
 	}
 
-	// Get should return the last idle connection and clean the others
-	c := pool.first()
+	conn.Close()
+}
+
+func TestGetContextCancelled(t *testing.T) {
+	pool := &Pool{MaxOpen: 1}
+	pool.Dial = func() (*Client, error) {
+		return &Client{}, nil
+	}
 
-	if c != pool.idle[0] {
-		t.Error("Expected to get first connection in idle slice")
+	conn, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	// Empty pool should return nil
-	emptyPool := &Pool{}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = pool.GetContext(ctx)
+	if err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
 
-	c = emptyPool.first()
+	conn.Close()
+}
 
-	if c != nil {
-		t.Errorf("Expected nil, got %T", c)
+func TestMinIdleWarmup(t *testing.T) {
+	pool := &Pool{MinIdle: 2, MaxOpen: 5}
+	pool.Dial = func() (*Client, error) {
+		return &Client{}, nil
+	}
+
+	// Trigger warmup the same way a first Get would, without consuming the
+	// connection it produces.
+	pool.mu.Lock()
+	pool.maybeWarmupLocked()
+	pool.mu.Unlock()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		pool.mu.Lock()
+		n := len(pool.idle)
+		pool.mu.Unlock()
+		if n >= 2 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if len(pool.idle) != 2 {
+		t.Errorf("Expected 2 warmed idle connections, got %d", len(pool.idle))
+	}
+	if pool.open != 2 {
+		t.Errorf("Expected 2 open connections, got %d", pool.open)
+	}
+}
+
+func TestMinIdleWarmupRespectsMaxIdle(t *testing.T) {
+	pool := &Pool{MinIdle: 3, MaxIdle: 1, MaxOpen: 5}
+	pool.Dial = func() (*Client, error) {
+		return &Client{}, nil
+	}
+
+	pool.mu.Lock()
+	pool.maybeWarmupLocked()
+	pool.mu.Unlock()
+
+	time.Sleep(200 * time.Millisecond)
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if len(pool.idle) != 1 {
+		t.Errorf("Expected idle to be capped at MaxIdle=1, got %d", len(pool.idle))
+	}
+}
+
+func TestIdlePingTimeoutEvictsStaleConnection(t *testing.T) {
+	stale := &Client{}
+	fresh := &Client{}
+
+	pool := &Pool{IdlePingTimeout: 10 * time.Millisecond}
+	pool.idle = []*idleConnection{
+		{pc: &PooledConnection{Pool: pool, Client: stale}, since: time.Now().Add(-time.Hour)},
+	}
+	pool.open = 1
+
+	var tested *Client
+	pool.TestOnBorrow = func(c *Client, idleSince time.Time) error {
+		tested = c
+		return errors.New("connection is dead")
+	}
+	pool.Dial = func() (*Client, error) {
+		return fresh, nil
+	}
+
+	conn, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
 	}
+	if tested != stale {
+		t.Error("Expected TestOnBorrow to be called with the stale connection")
+	}
+	if conn.Client != fresh {
+		t.Error("Expected the stale connection to be discarded and a fresh one dialed")
+	}
+	if pool.open != 1 {
+		t.Errorf("Expected open to settle back at 1, got %d", pool.open)
+	}
+}
+
+func TestIdlePingTimeoutSkipsFreshConnection(t *testing.T) {
+	client := &Client{}
+
+	pool := &Pool{IdlePingTimeout: time.Hour}
+	pool.idle = []*idleConnection{
+		{pc: &PooledConnection{Pool: pool, Client: client}, since: time.Now()},
+	}
+	pool.open = 1
+
+	called := false
+	pool.TestOnBorrow = func(c *Client, idleSince time.Time) error {
+		called = true
+		return nil
+	}
+
+	conn, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if called {
+		t.Error("Expected TestOnBorrow not to be called for a connection within IdlePingTimeout")
+	}
+	if conn.Client != client {
+		t.Error("Expected the idle connection to be reused")
+	}
+}
+
+func TestStatsTracksHitsAndMisses(t *testing.T) {
+	client := &Client{}
+	pool := &Pool{}
+	pool.Dial = func() (*Client, error) {
+		return client, nil
+	}
+
+	conn, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats := pool.Stats()
+	if stats.Dials != 1 || stats.Misses != 1 || stats.Hits != 0 {
+		t.Errorf("Expected 1 dial/miss and 0 hits after first Get, got %+v", stats)
+	}
+
+	conn.Close()
+
+	if _, err := pool.Get(); err != nil {
+		t.Fatal(err)
+	}
+
+	stats = pool.Stats()
+	if stats.Dials != 1 || stats.Misses != 1 || stats.Hits != 1 {
+		t.Errorf("Expected 1 dial/miss and 1 hit after reuse, got %+v", stats)
+	}
+	if stats.OpenConnections != 1 {
+		t.Errorf("Expected 1 open connection, got %d", stats.OpenConnections)
+	}
+}
+
+func TestStatsTracksTimeouts(t *testing.T) {
+	pool := &Pool{MaxOpen: 1, PoolTimeout: 10 * time.Millisecond}
+	pool.Dial = func() (*Client, error) {
+		return &Client{}, nil
+	}
+
+	conn, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := pool.Get(); err != ErrPoolExhausted {
+		t.Fatalf("Expected ErrPoolExhausted, got %v", err)
+	}
+
+	stats := pool.Stats()
+	if stats.Timeouts != 1 {
+		t.Errorf("Expected 1 timeout, got %d", stats.Timeouts)
+	}
+	if stats.Waiters != 1 {
+		t.Errorf("Expected 1 waiter, got %d", stats.Waiters)
+	}
+
+	conn.Close()
+}
+
+func TestOnEventFiresOnDial(t *testing.T) {
+	var events []PoolEventType
+	pool := &Pool{OnEvent: func(e PoolEvent) {
+		events = append(events, e.Type)
+	}}
+	pool.Dial = func() (*Client, error) {
+		return &Client{}, nil
+	}
+
+	if _, err := pool.Get(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 1 || events[0] != EventDial {
+		t.Errorf("Expected a single EventDial, got %v", events)
+	}
+}
+
+func TestDialRateLimitSpacesDials(t *testing.T) {
+	pool := &Pool{DialRateLimit: 30 * time.Millisecond}
+	pool.Dial = func() (*Client, error) {
+		return &Client{}, nil
+	}
+
+	start := time.Now()
+	conn1, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn2, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("Expected second dial to be delayed by DialRateLimit, only took %v", elapsed)
+	}
+
+	conn1.Close()
+	conn2.Close()
+}
+
+func TestDialRateLimitReleasesSlotOnCancel(t *testing.T) {
+	pool := &Pool{DialRateLimit: time.Hour}
+	pool.Dial = func() (*Client, error) {
+		return &Client{}, nil
+	}
+
+	conn, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := pool.GetContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+
+	pool.mu.Lock()
+	open := pool.open
+	pool.mu.Unlock()
+	if open != 1 {
+		t.Errorf("Expected reserved open slot to be released, got open=%d", open)
+	}
+
+	conn.Close()
 }
 
 func TestGetAndDial(t *testing.T) {